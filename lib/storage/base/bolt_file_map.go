@@ -0,0 +1,315 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/spf13/afero"
+	bolt "go.etcd.io/bbolt"
+)
+
+var entriesBucket = []byte("entries")
+
+// present is the marker value stored under an entry's name key in the bolt
+// bucket. The bucket only needs to durably record which names exist and when
+// they were last touched; the FileEntry content and its own metadata
+// sidecars already live on disk at deterministic, factory-derived paths, so
+// there is nothing else about a FileEntry that needs to be serialized here.
+var present = []byte{1}
+
+// boltFileMap is a FileMap backed by an embedded bbolt KV store. Unlike
+// lruFileMap / latFileMap, it does not keep every FileEntry resident in
+// memory: the bucket on disk is the index of record, and FileEntry objects
+// are materialized lazily on first access (by asking factory to reconstruct
+// the entry for a name) and cached in a small in-memory shadow map guarded by
+// locks, mirroring the locking scheme used by the other FileMap
+// implementations in this package.
+type boltFileMap struct {
+	sync.Mutex
+
+	db      *bolt.DB
+	clk     clock.Clock
+	factory FileEntryFactory
+
+	// locks holds one mutex per currently-referenced entry name, so
+	// concurrent LoadOrStore/LoadForRead/LoadForWrite/Delete calls on the
+	// same name serialize the same way they do for the in-memory FileMaps.
+	locks map[string]*sync.Mutex
+
+	// live caches FileEntry objects that have been materialized from disk
+	// since the process started, so repeated access to a hot entry does not
+	// re-materialize it every time.
+	live map[string]FileEntry
+}
+
+// NewBoltFileMap initializes a FileMap persisted to an embedded bbolt database
+// at path. Entry names and last-access timestamps are stored in the database
+// itself, so the set of known entries survives process restarts and does not
+// require holding every entry in memory at startup, unlike NewLATFileMap /
+// NewLRUFileMap. A FileEntry's content and its own metadata sidecars are left
+// where the rest of this package already puts them, on disk at a path
+// determined entirely by its name; after a restart this FileMap reconstructs
+// a FileEntry for a known name via NewLocalFileEntryFactory() rather than
+// trying to serialize the FileEntry itself.
+func NewBoltFileMap(path string, clk clock.Clock) (FileMap, error) {
+	return newBoltFileMap(path, clk, NewLocalFileEntryFactory(afero.NewOsFs()))
+}
+
+// newBoltFileMap is the shared constructor behind NewBoltFileMap and
+// NewPersistentCASFileStore, which need different FileEntryFactory
+// implementations to reconstruct entries after a restart.
+func newBoltFileMap(path string, clk clock.Clock, factory FileEntryFactory) (FileMap, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt db: %s", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create bucket: %s", err)
+	}
+
+	return &boltFileMap{
+		db:      db,
+		clk:     clk,
+		factory: factory,
+		locks:   make(map[string]*sync.Mutex),
+		live:    make(map[string]FileEntry),
+	}, nil
+}
+
+// lockFor returns the per-name mutex, creating it if this is the first
+// reference to name.
+func (m *boltFileMap) lockFor(name string) *sync.Mutex {
+	m.Lock()
+	defer m.Unlock()
+	l, ok := m.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[name] = l
+	}
+	return l
+}
+
+// exists reports whether name has a record in the bolt bucket.
+func (m *boltFileMap) exists(name string) bool {
+	found := false
+	m.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(entriesBucket).Get([]byte(name)) != nil
+		return nil
+	})
+	return found
+}
+
+// Contains implements FileMap.
+func (m *boltFileMap) Contains(name string) bool {
+	return m.exists(name)
+}
+
+// LoadOrStore implements FileMap.
+func (m *boltFileMap) LoadOrStore(name string, entry FileEntry, f func(string, FileEntry) error) (FileEntry, bool) {
+	l := m.lockFor(name)
+	l.Lock()
+	defer l.Unlock()
+
+	if m.exists(name) {
+		existing, ok := m.materializeLocked(name)
+		if !ok {
+			// The index entry disappeared between exists() and here; treat
+			// it as if it was never there.
+			return entry, false
+		}
+		return existing, true
+	}
+
+	if err := f(name, entry); err != nil {
+		return entry, false
+	}
+
+	if err := m.recordPresence(name); err != nil {
+		return entry, false
+	}
+	m.touch(name)
+
+	m.Lock()
+	m.live[name] = entry
+	m.Unlock()
+	return entry, false
+}
+
+// LoadForRead implements FileMap.
+func (m *boltFileMap) LoadForRead(name string, f func(string, FileEntry)) bool {
+	l := m.lockFor(name)
+	l.Lock()
+	defer l.Unlock()
+
+	entry, ok := m.materializeLocked(name)
+	if !ok {
+		return false
+	}
+	f(name, entry)
+	m.touch(name)
+	return true
+}
+
+// LoadForWrite implements FileMap.
+func (m *boltFileMap) LoadForWrite(name string, f func(string, FileEntry)) bool {
+	l := m.lockFor(name)
+	l.Lock()
+	defer l.Unlock()
+
+	entry, ok := m.materializeLocked(name)
+	if !ok {
+		return false
+	}
+	f(name, entry)
+	m.touch(name)
+	return true
+}
+
+// Delete implements FileMap.
+func (m *boltFileMap) Delete(name string, f func(string, FileEntry) error) bool {
+	l := m.lockFor(name)
+	l.Lock()
+	defer l.Unlock()
+
+	entry, ok := m.materializeLocked(name)
+	if !ok {
+		return false
+	}
+
+	// Deletion proceeds regardless of f's error, matching the LAT/LRU
+	// FileMap semantics exercised by TestFileMap: the caller's cleanup may
+	// fail, but the entry is still removed from the index.
+	f(name, entry)
+
+	m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+		b.Delete([]byte(name))
+		b.Delete(lastAccessKey(name))
+		return nil
+	})
+
+	m.Lock()
+	delete(m.live, name)
+	delete(m.locks, name)
+	m.Unlock()
+	return true
+}
+
+// materializeLocked returns the FileEntry for name, reconstructing it via
+// factory on first access after a restart and caching the result for
+// subsequent calls. Callers must already hold name's per-name lock.
+func (m *boltFileMap) materializeLocked(name string) (FileEntry, bool) {
+	m.Lock()
+	entry, ok := m.live[name]
+	m.Unlock()
+	if ok {
+		return entry, true
+	}
+
+	if !m.exists(name) {
+		return nil, false
+	}
+
+	entry = m.factory.Create(name)
+
+	m.Lock()
+	m.live[name] = entry
+	m.Unlock()
+	return entry, true
+}
+
+// recordPresence marks name as known in the bolt bucket.
+func (m *boltFileMap) recordPresence(name string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(name), present)
+	})
+}
+
+// touch refreshes the last-access timestamp used by GC to identify cold
+// entries, analogous to the LAT tracked by latFileMap.
+func (m *boltFileMap) touch(name string) {
+	ts := []byte(fmt.Sprintf("%d", m.clk.Now().UnixNano()))
+	m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put(lastAccessKey(name), ts)
+	})
+}
+
+func lastAccessKey(name string) []byte {
+	return []byte("_lat:" + name)
+}
+
+// ListNames returns the names of every entry currently stored in the bucket.
+// It is used by ChecksumWildcard to enumerate candidates for glob matching.
+func (m *boltFileMap) ListNames() []string {
+	var names []string
+	m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			if len(k) > 0 && k[0] != '_' {
+				names = append(names, string(k))
+			}
+			return nil
+		})
+	})
+	return names
+}
+
+// GC removes entries whose last-access timestamp is older than maxAge, to
+// bound the size of the on-disk index in the same way the LAT eviction policy
+// bounds latFileMap's memory usage. An entry is only ever missing its LAT key
+// if it predates this field being introduced, so a missing key is treated as
+// "never touched" and therefore eligible for collection rather than exempt
+// from it. It returns the number of entries removed.
+func (m *boltFileMap) GC(maxAge time.Duration) (int, error) {
+	cutoff := m.clk.Now().Add(-maxAge).UnixNano()
+	var stale []string
+
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+		for _, name := range m.ListNames() {
+			v := b.Get(lastAccessKey(name))
+			var ts int64
+			if v != nil {
+				fmt.Sscanf(string(v), "%d", &ts)
+			}
+			if ts < cutoff {
+				stale = append(stale, name)
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, name := range stale {
+		if m.Delete(name, func(string, FileEntry) error { return nil }) {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Close releases the underlying bolt database handle.
+func (m *boltFileMap) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,74 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+// fileMapBoltFixture wires a boltFileMap backed by a temp database into the
+// shared fileMapTestBundle so TestFileMap exercises it with the same
+// concurrency invariants as SimpleFileMap and LRUFileMap.
+func fileMapBoltFixture() (bundle *fileMapTestBundle, cleanup func()) {
+	dir, err := ioutil.TempDir("", "bolt_file_map_test")
+	if err != nil {
+		panic(err)
+	}
+
+	fm, err := NewBoltFileMap(filepath.Join(dir, "cache.db"), clock.New())
+	if err != nil {
+		panic(err)
+	}
+
+	bundle = fileMapTestFixture(fm)
+	return bundle, func() {
+		fm.(*boltFileMap).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltFileMapGC(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "bolt_file_map_test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	clk := clock.NewMock()
+	fm, err := NewBoltFileMap(filepath.Join(dir, "cache.db"), clk)
+	require.NoError(err)
+	defer fm.(*boltFileMap).Close()
+
+	fe := newTestFileEntry()
+	_, loaded := fm.LoadOrStore(fe.GetName(), fe, func(name string, entry FileEntry) error {
+		return entry.Create(testState1, 0)
+	})
+	require.False(loaded)
+	require.True(fm.Contains(fe.GetName()))
+
+	clk.Add(2 * time.Hour)
+
+	removed, err := fm.(*boltFileMap).GC(time.Hour)
+	require.NoError(err)
+	require.Equal(1, removed)
+	require.False(fm.Contains(fe.GetName()))
+}
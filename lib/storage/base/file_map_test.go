@@ -33,6 +33,8 @@ func TestFileMap(t *testing.T) {
 	}{
 		{"SimpleFileMap", fileMapSimpleFixture},
 		{"LRUFileMap", fileMapLRUFixture},
+		{"SizedLRUFileMap", fileMapSizedLRUFixture},
+		{"BoltFileMap", fileMapBoltFixture},
 	}
 
 	tests := []func(require *require.Assertions, bundle *fileMapTestBundle){
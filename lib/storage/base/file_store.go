@@ -16,6 +16,7 @@ package base
 
 import (
 	"github.com/andres-erbsen/clock"
+	"github.com/spf13/afero"
 )
 
 // FileStore manages files and their metadata. Actual operations are done through FileOp.
@@ -29,15 +30,18 @@ type FileStore interface {
 // Delete opereration should access data in this order:
 //   map load -> file lock -> verify not deleted -> file/metadata change -> delete from map -> file unlock
 type localFileStore struct {
+	fs               afero.Fs         // Used for dependency injection.
 	fileEntryFactory FileEntryFactory // Used for dependency injection.
 	fileMap          FileMap          // Used for dependency injection.
 }
 
 // NewLocalFileStore initializes and returns a new FileStore. It allows dependency injection.
 func NewLocalFileStore(clk clock.Clock) FileStore {
-	m := NewLATFileMap(clk)
+	fs := afero.NewOsFs()
+	m := newNameTrackingFileMap(NewLATFileMap(clk))
 	return &localFileStore{
-		fileEntryFactory: NewLocalFileEntryFactory(),
+		fs:               fs,
+		fileEntryFactory: NewLocalFileEntryFactory(fs),
 		fileMap:          m,
 	}
 }
@@ -46,9 +50,11 @@ func NewLocalFileStore(clk clock.Clock) FileStore {
 // It uses the first few bytes of file digest (which is also used as file name) as shard ID.
 // For every byte, one more level of directories will be created.
 func NewCASFileStore(clk clock.Clock) FileStore {
-	m := NewLATFileMap(clk)
+	fs := afero.NewOsFs()
+	m := newNameTrackingFileMap(NewLATFileMap(clk))
 	return &localFileStore{
-		fileEntryFactory: NewCASFileEntryFactory(),
+		fs:               fs,
+		fileEntryFactory: NewCASFileEntryFactory(fs),
 		fileMap:          m,
 	}
 }
@@ -56,13 +62,60 @@ func NewCASFileStore(clk clock.Clock) FileStore {
 // NewLRUFileStore initializes and returns a new LRU FileStore.
 // When size exceeds limit, the least recently accessed entry will be removed.
 func NewLRUFileStore(size int, clk clock.Clock) FileStore {
-	m := NewLRUFileMap(size, clk)
+	fs := afero.NewOsFs()
+	m := newNameTrackingFileMap(NewLRUFileMap(size, clk))
 	return &localFileStore{
-		fileEntryFactory: NewLocalFileEntryFactory(),
+		fs:               fs,
+		fileEntryFactory: NewLocalFileEntryFactory(fs),
 		fileMap:          m,
 	}
 }
 
+// NewFileStoreWithFs initializes and returns a new FileStore whose FileEntry
+// objects perform all disk I/O through fs instead of talking to the "os"
+// package directly. NewMemFileStore is defined in terms of it;
+// NewLocalFileStore / NewCASFileStore build the same localFileStore
+// themselves with afero.NewOsFs(). Callers that need a non-default backend
+// (e.g. an afero S3 or GCS adapter for a remote CAS shard tree) can call it
+// directly.
+func NewFileStoreWithFs(fs afero.Fs, factory FileEntryFactory, m FileMap) FileStore {
+	return &localFileStore{
+		fs:               fs,
+		fileEntryFactory: factory,
+		fileMap:          m,
+	}
+}
+
+// NewMemFileStore initializes and returns a FileStore entirely backed by an
+// in-memory afero.Fs: the FileEntryFactory, and every FileOp created from the
+// returned FileStore, read and write file content through that MemMapFs, so
+// nothing this FileStore creates ever touches real disk. It is meant for
+// tests that exercise FileStore / FileOp behavior without paying for tmpdir
+// creation and teardown, and for operators who want an ephemeral,
+// tmpfs-only layer cache.
+func NewMemFileStore(clk clock.Clock) FileStore {
+	fs := afero.NewMemMapFs()
+	return NewFileStoreWithFs(fs, NewLocalFileEntryFactory(fs), newNameTrackingFileMap(NewLATFileMap(clk)))
+}
+
+// NewPersistentCASFileStore initializes and returns a Content-Addressable
+// FileStore whose index is backed by an embedded KV store at path instead of
+// an in-memory map, so the cache metadata survives process restarts and a
+// single host can track far more cache entries than fit comfortably in RAM.
+// See NewBoltFileMap.
+func NewPersistentCASFileStore(path string, clk clock.Clock) (FileStore, error) {
+	fs := afero.NewOsFs()
+	m, err := newBoltFileMap(path, clk, NewCASFileEntryFactory(fs))
+	if err != nil {
+		return nil, err
+	}
+	return &localFileStore{
+		fs:               fs,
+		fileEntryFactory: NewCASFileEntryFactory(fs),
+		fileMap:          m,
+	}, nil
+}
+
 // NewFileOp contructs a new FileOp object.
 func (s *localFileStore) NewFileOp() FileOp {
 	return NewLocalFileOp(s)
@@ -0,0 +1,58 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMemFileStoreUsesInMemoryFs(t *testing.T) {
+	require := require.New(t)
+
+	s := NewMemFileStore(clock.New())
+	lfs, ok := s.(*localFileStore)
+	require.True(ok)
+
+	_, ok = lfs.fs.(*afero.MemMapFs)
+	require.True(ok)
+
+	// Content written through the store's fs must be visible there and must
+	// never touch the real filesystem at the same path.
+	path := "/mem_file_store_test/hello.txt"
+	require.NoError(afero.WriteFile(lfs.fs, path, []byte("hello"), 0644))
+
+	ok, err := afero.Exists(lfs.fs, path)
+	require.NoError(err)
+	require.True(ok)
+
+	ok, err = afero.Exists(afero.NewOsFs(), path)
+	require.NoError(err)
+	require.False(ok)
+}
+
+func TestNewFileStoreWithFsDefaultsPreserveOsFs(t *testing.T) {
+	require := require.New(t)
+
+	s := NewLocalFileStore(clock.New())
+	lfs, ok := s.(*localFileStore)
+	require.True(ok)
+
+	_, ok = lfs.fs.(*afero.OsFs)
+	require.True(ok)
+}
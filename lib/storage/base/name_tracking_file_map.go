@@ -0,0 +1,81 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import "sync"
+
+// nameTrackingFileMap wraps a FileMap that does not already implement
+// ListNames (namely latFileMap and lruFileMap) with an in-memory index of the
+// names it has seen, so ChecksumWildcard can enumerate entries to glob-match
+// against on an ordinary NewLocalFileStore / NewCASFileStore / NewLRUFileStore
+// the same way it already can on NewPersistentCASFileStore (boltFileMap) and
+// NewSizedLRUFileStore (sizedLRUFileMap).
+type nameTrackingFileMap struct {
+	FileMap
+
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+// newNameTrackingFileMap wraps m, unless m already implements ListNames, in
+// which case it is returned unchanged.
+func newNameTrackingFileMap(m FileMap) FileMap {
+	if _, ok := m.(interface{ ListNames() []string }); ok {
+		return m
+	}
+	return &nameTrackingFileMap{
+		FileMap: m,
+		names:   make(map[string]struct{}),
+	}
+}
+
+// LoadOrStore implements FileMap. The underlying FileMap reports loaded=false
+// both when it actually stored entry and when the caller's f aborted the
+// store with an error, so name is only recorded once Contains confirms the
+// entry is actually present; otherwise a transient create failure would
+// permanently leave a phantom name in the index that ListNames later hands
+// out but can never be loaded.
+func (m *nameTrackingFileMap) LoadOrStore(name string, entry FileEntry, f func(string, FileEntry) error) (FileEntry, bool) {
+	result, loaded := m.FileMap.LoadOrStore(name, entry, f)
+	if !loaded && m.FileMap.Contains(name) {
+		m.mu.Lock()
+		m.names[name] = struct{}{}
+		m.mu.Unlock()
+	}
+	return result, loaded
+}
+
+// Delete implements FileMap.
+func (m *nameTrackingFileMap) Delete(name string, f func(string, FileEntry) error) bool {
+	deleted := m.FileMap.Delete(name, f)
+	if deleted {
+		m.mu.Lock()
+		delete(m.names, name)
+		m.mu.Unlock()
+	}
+	return deleted
+}
+
+// ListNames returns the names of every entry added via LoadOrStore and not
+// yet removed via Delete.
+func (m *nameTrackingFileMap) ListNames() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.names))
+	for name := range m.names {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,392 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"container/list"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/spf13/afero"
+)
+
+// Stats reports cache effectiveness counters for a FileStore whose FileMap
+// tracks them, such as the one returned by NewSizedLRUFileStore.
+type Stats struct {
+	Hits       uint64
+	Misses     uint64
+	Spills     uint64
+	Rehydrates uint64
+}
+
+// statsFileStore is implemented by FileStore implementations that expose
+// Stats(), such as the one returned by NewSizedLRUFileStore.
+type statsFileStore interface {
+	Stats() Stats
+}
+
+// sizedLRUElement is the bookkeeping record kept in the two-tier LRU: one
+// list element per entry, tracking its on-disk byte size and whether its
+// content currently lives in the hot store or has been spilled to spillDir.
+type sizedLRUElement struct {
+	name     string
+	entry    FileEntry
+	bytes    int64
+	spilled  bool
+	listElem *list.Element
+}
+
+// sizedLRUFileMap is a FileMap that bounds the cache by total content bytes
+// rather than entry count. When a LoadOrStore pushes the map over maxBytes,
+// the coldest entries are evicted by moving their content into spillDir and
+// marking their record as spilled, with the FileEntry and its byte size kept
+// in the index; spilled entries are
+// transparently rehydrated back into the hot tier on the next LoadForRead.
+type sizedLRUFileMap struct {
+	sync.Mutex
+
+	fs        afero.Fs // Used for dependency injection; see NewSizedLRUFileStoreWithFs.
+	maxBytes  int64
+	usedBytes int64
+	spillDir  string
+	clk       clock.Clock
+	lru       *list.List // front = most recently used
+	index     map[string]*sizedLRUElement
+
+	// locks holds one mutex per currently-referenced name, serializing the
+	// check-then-act sequence in LoadOrStore/LoadForWrite/Delete the same
+	// way boltFileMap.lockFor does, so two concurrent calls for the same
+	// not-yet-present name can't both decide to create it.
+	locks map[string]*sync.Mutex
+
+	hits, misses, spills, rehydrates uint64
+}
+
+// NewSizedLRUFileStore initializes a FileStore whose cache is bounded by
+// total on-disk byte size instead of entry count. Once the cache exceeds
+// maxBytes, the least recently used entries are moved to spillDir (a cold
+// tier on the same or a slower disk) rather than deleted outright, so a
+// subsequent LoadForRead can rehydrate them. Call Stats() on the returned
+// FileStore to read hit/miss/spill/rehydrate counters.
+func NewSizedLRUFileStore(maxBytes int64, spillDir string, clk clock.Clock) FileStore {
+	return NewSizedLRUFileStoreWithFs(afero.NewOsFs(), maxBytes, spillDir, clk)
+}
+
+// NewSizedLRUFileStoreWithFs is NewSizedLRUFileStore with the backing
+// afero.Fs injected, the same way NewFileStoreWithFs lets callers swap in a
+// non-default backend (e.g. afero.NewMemMapFs() for tests) for the other
+// FileStore implementations in this package.
+func NewSizedLRUFileStoreWithFs(fs afero.Fs, maxBytes int64, spillDir string, clk clock.Clock) FileStore {
+	m := &sizedLRUFileMap{
+		fs:       fs,
+		maxBytes: maxBytes,
+		spillDir: spillDir,
+		clk:      clk,
+		lru:      list.New(),
+		index:    make(map[string]*sizedLRUElement),
+		locks:    make(map[string]*sync.Mutex),
+	}
+	return &sizedLRUFileStoreWrapper{
+		localFileStore: &localFileStore{
+			fs:               fs,
+			fileEntryFactory: NewLocalFileEntryFactory(fs),
+			fileMap:          m,
+		},
+		fileMap: m,
+	}
+}
+
+// sizedLRUFileStoreWrapper embeds localFileStore so NewFileOp keeps working
+// unchanged, while additionally exposing Stats() from the underlying
+// sizedLRUFileMap.
+type sizedLRUFileStoreWrapper struct {
+	*localFileStore
+	fileMap *sizedLRUFileMap
+}
+
+// Stats returns a snapshot of the cache's hit/miss/spill/rehydrate counters.
+func (s *sizedLRUFileStoreWrapper) Stats() Stats {
+	return Stats{
+		Hits:       atomic.LoadUint64(&s.fileMap.hits),
+		Misses:     atomic.LoadUint64(&s.fileMap.misses),
+		Spills:     atomic.LoadUint64(&s.fileMap.spills),
+		Rehydrates: atomic.LoadUint64(&s.fileMap.rehydrates),
+	}
+}
+
+// lockFor returns the per-name mutex, creating it if this is the first
+// reference to name.
+func (m *sizedLRUFileMap) lockFor(name string) *sync.Mutex {
+	m.Lock()
+	defer m.Unlock()
+	l, ok := m.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[name] = l
+	}
+	return l
+}
+
+// Contains implements FileMap.
+func (m *sizedLRUFileMap) Contains(name string) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.index[name]
+	return ok
+}
+
+// LoadOrStore implements FileMap.
+func (m *sizedLRUFileMap) LoadOrStore(name string, entry FileEntry, f func(string, FileEntry) error) (FileEntry, bool) {
+	l := m.lockFor(name)
+	l.Lock()
+	defer l.Unlock()
+
+	m.Lock()
+	if el, ok := m.index[name]; ok {
+		m.lru.MoveToFront(el.listElem)
+		m.Unlock()
+		return el.entry, true
+	}
+	m.Unlock()
+
+	if err := f(name, entry); err != nil {
+		return entry, false
+	}
+
+	size, _ := m.fileEntrySize(entry)
+
+	m.Lock()
+	el := &sizedLRUElement{name: name, entry: entry, bytes: size}
+	el.listElem = m.lru.PushFront(el)
+	m.index[name] = el
+	m.usedBytes += size
+	m.Unlock()
+
+	m.evictIfNeeded()
+	return entry, false
+}
+
+// LoadForRead implements FileMap. It transparently rehydrates a spilled entry
+// before invoking f.
+func (m *sizedLRUFileMap) LoadForRead(name string, f func(string, FileEntry)) bool {
+	m.Lock()
+	el, ok := m.index[name]
+	if !ok {
+		m.Unlock()
+		atomic.AddUint64(&m.misses, 1)
+		return false
+	}
+	m.lru.MoveToFront(el.listElem)
+	spilled := el.spilled
+	m.Unlock()
+
+	if spilled {
+		if err := m.rehydrate(el); err != nil {
+			return false
+		}
+	}
+
+	atomic.AddUint64(&m.hits, 1)
+	f(name, el.entry)
+	return true
+}
+
+// LoadForWrite implements FileMap.
+func (m *sizedLRUFileMap) LoadForWrite(name string, f func(string, FileEntry)) bool {
+	l := m.lockFor(name)
+	l.Lock()
+	defer l.Unlock()
+
+	m.Lock()
+	el, ok := m.index[name]
+	if !ok {
+		m.Unlock()
+		return false
+	}
+	m.lru.MoveToFront(el.listElem)
+	spilled := el.spilled
+	m.Unlock()
+
+	if spilled {
+		if err := m.rehydrate(el); err != nil {
+			return false
+		}
+	}
+
+	f(name, el.entry)
+
+	size, _ := m.fileEntrySize(el.entry)
+	m.Lock()
+	m.usedBytes += size - el.bytes
+	el.bytes = size
+	m.Unlock()
+
+	m.evictIfNeeded()
+	return true
+}
+
+// Delete implements FileMap. A spilled entry is rehydrated first so f's
+// cleanup (e.g. entry.Delete()) removes the content that actually exists at
+// entry.GetPath(), rather than leaking the copy left behind in spillDir.
+func (m *sizedLRUFileMap) Delete(name string, f func(string, FileEntry) error) bool {
+	l := m.lockFor(name)
+	l.Lock()
+	defer l.Unlock()
+
+	m.Lock()
+	el, ok := m.index[name]
+	if !ok {
+		m.Unlock()
+		return false
+	}
+	spilled := el.spilled
+	m.Unlock()
+
+	if spilled {
+		if err := m.rehydrate(el); err != nil {
+			return false
+		}
+	}
+
+	f(name, el.entry)
+
+	m.Lock()
+	defer m.Unlock()
+	m.lru.Remove(el.listElem)
+	delete(m.index, name)
+	delete(m.locks, name)
+	// A spilled el was rehydrated above, so usedBytes already reflects its
+	// bytes again. el.spilled is only true here if a concurrent evictIfNeeded
+	// spilled el after that point, and spill already backed its bytes out of
+	// usedBytes.
+	if !el.spilled {
+		m.usedBytes -= el.bytes
+	}
+	return true
+}
+
+// ListNames returns the names of every entry tracked by the map, hot or
+// spilled, so ChecksumWildcard can still glob-match against cold entries.
+func (m *sizedLRUFileMap) ListNames() []string {
+	m.Lock()
+	defer m.Unlock()
+	names := make([]string, 0, len(m.index))
+	for name := range m.index {
+		names = append(names, name)
+	}
+	return names
+}
+
+// evictIfNeeded spills the coldest entries to spillDir until usedBytes is
+// back under maxBytes.
+func (m *sizedLRUFileMap) evictIfNeeded() {
+	for {
+		m.Lock()
+		if m.usedBytes <= m.maxBytes {
+			m.Unlock()
+			return
+		}
+		back := m.lru.Back()
+		for back != nil {
+			el := back.Value.(*sizedLRUElement)
+			if !el.spilled {
+				break
+			}
+			back = back.Prev()
+		}
+		if back == nil {
+			m.Unlock()
+			return
+		}
+		el := back.Value.(*sizedLRUElement)
+		m.Unlock()
+
+		m.spill(el)
+	}
+}
+
+// spill moves el's content out of the hot store and into spillDir and marks
+// el as spilled, keeping its FileEntry and byte size in the index so a later
+// LoadForRead can rehydrate it.
+func (m *sizedLRUFileMap) spill(el *sizedLRUElement) error {
+	src, err := el.entry.GetPath()
+	if err != nil {
+		return err
+	}
+
+	if err := m.fs.MkdirAll(m.spillDir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(m.spillDir, el.name)
+	if err := m.fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := m.fs.Rename(src, dst); err != nil {
+		return err
+	}
+
+	m.Lock()
+	el.spilled = true
+	m.usedBytes -= el.bytes
+	m.Unlock()
+
+	atomic.AddUint64(&m.spills, 1)
+	return nil
+}
+
+// rehydrate moves el's content back from spillDir into the hot store.
+func (m *sizedLRUFileMap) rehydrate(el *sizedLRUElement) error {
+	m.Lock()
+	if !el.spilled {
+		m.Unlock()
+		return nil
+	}
+	m.Unlock()
+
+	src := filepath.Join(m.spillDir, el.name)
+	dst, err := el.entry.GetPath()
+	if err != nil {
+		return err
+	}
+	if err := m.fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := m.fs.Rename(src, dst); err != nil {
+		return err
+	}
+
+	m.Lock()
+	el.spilled = false
+	m.usedBytes += el.bytes
+	m.Unlock()
+
+	atomic.AddUint64(&m.rehydrates, 1)
+	return nil
+}
+
+// fileEntrySize returns the on-disk byte size of entry's content.
+func (m *sizedLRUFileMap) fileEntrySize(entry FileEntry) (int64, error) {
+	p, err := entry.GetPath()
+	if err != nil {
+		return 0, err
+	}
+	fi, err := m.fs.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
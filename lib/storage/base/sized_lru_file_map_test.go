@@ -0,0 +1,139 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// fileMapSizedLRUFixture wires a sizedLRUFileMap backed by a temp spill
+// directory into the shared fileMapTestBundle so TestFileMap exercises it
+// with the same concurrency invariants as the other FileMap implementations.
+func fileMapSizedLRUFixture() (bundle *fileMapTestBundle, cleanup func()) {
+	spillDir, err := ioutil.TempDir("", "sized_lru_file_map_test")
+	if err != nil {
+		panic(err)
+	}
+
+	// A large maxBytes keeps the fixture from spilling entries mid-test;
+	// eviction behavior itself is covered separately below.
+	s := NewSizedLRUFileStore(1<<30, spillDir, clock.New())
+	fm := s.(*sizedLRUFileStoreWrapper).fileMap
+
+	bundle = fileMapTestFixture(fm)
+	return bundle, func() {
+		os.RemoveAll(spillDir)
+	}
+}
+
+func TestSizedLRUFileStoreDoesNotSpillUnderMaxBytes(t *testing.T) {
+	require := require.New(t)
+
+	spillDir, err := ioutil.TempDir("", "sized_lru_file_map_test")
+	require.NoError(err)
+	defer os.RemoveAll(spillDir)
+
+	s := NewSizedLRUFileStore(1024, spillDir, clock.New())
+	fm := s.(*sizedLRUFileStoreWrapper).fileMap
+
+	fe := newTestFileEntry()
+	_, loaded := fm.LoadOrStore(fe.GetName(), fe, func(name string, entry FileEntry) error {
+		return entry.Create(testState1, 0)
+	})
+	require.False(loaded)
+	require.True(fm.Contains(fe.GetName()))
+
+	stats := s.(statsFileStore).Stats()
+	require.Equal(uint64(0), stats.Spills)
+}
+
+// TestNewSizedLRUFileStoreWithFsUsesInMemoryFs exercises the fs plumbing
+// NewSizedLRUFileStoreWithFs adds: unlike the other tests in this file, it
+// never touches a real tmpdir for either the hot store or spillDir, since
+// every entry and every spill/rehydrate Rename goes through the injected
+// MemMapFs.
+func TestNewSizedLRUFileStoreWithFsUsesInMemoryFs(t *testing.T) {
+	require := require.New(t)
+
+	fs := afero.NewMemMapFs()
+	s := NewSizedLRUFileStoreWithFs(fs, 1024, "/spill", clock.New())
+	fm := s.(*sizedLRUFileStoreWrapper).fileMap
+	require.True(fm.fs == fs)
+
+	fe := NewLocalFileEntryFactory(fs).Create("mem_sized_lru_entry")
+	_, loaded := fm.LoadOrStore(fe.GetName(), fe, func(name string, entry FileEntry) error {
+		return entry.Create(testState1, 0)
+	})
+	require.False(loaded)
+
+	path, err := fe.GetPath()
+	require.NoError(err)
+
+	ok, err := afero.Exists(fs, path)
+	require.NoError(err)
+	require.True(ok)
+
+	ok, err = afero.Exists(afero.NewOsFs(), path)
+	require.NoError(err)
+	require.False(ok)
+}
+
+func TestSizedLRUFileMapRehydratesSpilledEntry(t *testing.T) {
+	require := require.New(t)
+
+	spillDir, err := ioutil.TempDir("", "sized_lru_file_map_test")
+	require.NoError(err)
+	defer os.RemoveAll(spillDir)
+
+	fm := &sizedLRUFileMap{
+		fs:       afero.NewOsFs(),
+		maxBytes: 0,
+		spillDir: spillDir,
+		clk:      clock.New(),
+		lru:      list.New(),
+		index:    make(map[string]*sizedLRUElement),
+		locks:    make(map[string]*sync.Mutex),
+	}
+
+	fe := newTestFileEntry()
+	require.NoError(fe.Create(testState1, 0))
+	path, err := fe.GetPath()
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(path, []byte("hello"), 0644))
+
+	fm.Lock()
+	el := &sizedLRUElement{name: fe.GetName(), entry: fe, bytes: 5}
+	el.listElem = fm.lru.PushFront(el)
+	fm.index[fe.GetName()] = el
+	fm.usedBytes = 5
+	fm.Unlock()
+
+	fm.evictIfNeeded()
+	require.True(el.spilled)
+	require.FileExists(filepath.Join(spillDir, fe.GetName()))
+
+	loaded := fm.LoadForRead(fe.GetName(), func(name string, entry FileEntry) {})
+	require.True(loaded)
+	require.False(el.spilled)
+}
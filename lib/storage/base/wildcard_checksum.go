@@ -0,0 +1,288 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/afero"
+)
+
+// FileEntryNotFoundError is returned when a wildcard pattern matches a name that
+// no longer has a corresponding entry in the store.
+type FileEntryNotFoundError struct {
+	Name string
+}
+
+func (e *FileEntryNotFoundError) Error() string {
+	return fmt.Sprintf("file entry not found: %s", e.Name)
+}
+
+// wildcardDigestMetadata caches the content digest of a FileEntry on disk, keyed off
+// the entry name and whether the digest was computed with symlinks followed. It is
+// read and written by ChecksumWildcard between scans so that repeated wildcard scans
+// over unchanged files do not re-hash their content. followLinks changes what content
+// checksumEntry actually hashes for a symlink entry, so it must be part of the cache
+// key: otherwise a scan with followLinks=true would read back (or clobber) the digest
+// cached by an earlier scan with followLinks=false for the same entry.
+type wildcardDigestMetadata struct {
+	digest      string
+	followLinks bool
+}
+
+func (m *wildcardDigestMetadata) GetSuffix() string {
+	if m.followLinks {
+		return "_wildcard_digest_followlinks"
+	}
+	return "_wildcard_digest"
+}
+
+func (m *wildcardDigestMetadata) Movable() bool {
+	return true
+}
+
+func (m *wildcardDigestMetadata) Serialize() ([]byte, error) {
+	return []byte(m.digest), nil
+}
+
+func (m *wildcardDigestMetadata) Deserialize(b []byte) error {
+	m.digest = string(b)
+	return nil
+}
+
+// splitWildcardPatterns splits a comma-separated pattern list into positive
+// (match) and negative (exclude, prefixed with "!") glob patterns.
+func splitWildcardPatterns(pattern string) (include, exclude []string) {
+	for _, p := range strings.Split(pattern, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if strings.HasPrefix(p, "!") {
+			exclude = append(exclude, p[1:])
+		} else {
+			include = append(include, p)
+		}
+	}
+	return include, exclude
+}
+
+// globToRegexp translates a single glob pattern supporting "*", "**", "?" and
+// character classes (e.g. "[a-z]") into an anchored regexp matching a "/"
+// separated relative path.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+				// Swallow a following path separator so "**/x" also matches "x".
+				if i+1 < len(runes) && runes[i+1] == '/' {
+					i++
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '.', '+', '(', ')', '|', '^', '$', '{', '}':
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		case '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j < len(runes) {
+				b.WriteString(string(runes[i : j+1]))
+				i = j
+			} else {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// matchesWildcard returns whether name matches pattern, which may contain
+// multiple comma-separated glob and "!"-prefixed exclusion sub-patterns.
+func matchesWildcard(pattern, name string) (bool, error) {
+	include, exclude := splitWildcardPatterns(pattern)
+	name = path.Clean(name)
+
+	matched := false
+	for _, p := range include {
+		re, err := globToRegexp(p)
+		if err != nil {
+			return false, err
+		}
+		if re.MatchString(name) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false, nil
+	}
+	for _, p := range exclude {
+		re, err := globToRegexp(p)
+		if err != nil {
+			return false, err
+		}
+		if re.MatchString(name) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ChecksumWildcard walks the store and returns a single stable digest over every
+// entry whose relative path matches pattern (a comma-separated list of glob
+// patterns, where a leading "!" excludes matches, e.g. "src/**/*.go,!**/*_test.go").
+// If followLinks is true, symlinked entries are resolved before hashing their
+// content. The per-file digest is cached on the matched FileEntry's metadata so
+// that a repeated scan over unchanged files does not re-hash their content.
+func (op *localFileOp) ChecksumWildcard(pattern string, followLinks bool) (digest.Digest, error) {
+	names, err := op.listNames()
+	if err != nil {
+		return "", err
+	}
+
+	type match struct {
+		name   string
+		digest string
+	}
+	var matches []match
+	for _, name := range names {
+		ok, err := matchesWildcard(pattern, name)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		d, err := op.entryDigest(name, followLinks)
+		if err != nil {
+			return "", err
+		}
+		matches = append(matches, match{name: name, digest: d})
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].name < matches[j].name })
+
+	digester := digest.Canonical.Digester()
+	for _, m := range matches {
+		digester.Hash().Write([]byte(m.name))
+		digester.Hash().Write([]byte(m.digest))
+	}
+	return digester.Digest(), nil
+}
+
+// entryDigest returns the cached content digest for name if present, otherwise
+// computes it, caches it on the entry's metadata, and returns it. The cache
+// hit path only needs to read the entry, but populating the cache mutates its
+// metadata, so that branch runs under LoadForWrite instead of LoadForRead:
+// otherwise two concurrent callers computing a not-yet-cached digest for the
+// same name could race on entry.SetMetadata.
+func (op *localFileOp) entryDigest(name string, followLinks bool) (string, error) {
+	var result string
+	var computeErr error
+	loaded := op.store.fileMap.LoadForRead(name, func(name string, entry FileEntry) {
+		md := &wildcardDigestMetadata{followLinks: followLinks}
+		if err := entry.GetMetadata(md); err == nil && md.digest != "" {
+			result = md.digest
+		}
+	})
+	if !loaded {
+		return "", &FileEntryNotFoundError{Name: name}
+	}
+	if result != "" {
+		return result, nil
+	}
+
+	loaded = op.store.fileMap.LoadForWrite(name, func(name string, entry FileEntry) {
+		md := &wildcardDigestMetadata{followLinks: followLinks}
+		if err := entry.GetMetadata(md); err == nil && md.digest != "" {
+			result = md.digest
+			return
+		}
+
+		d, err := op.checksumEntry(entry, followLinks)
+		if err != nil {
+			computeErr = err
+			return
+		}
+		result = d.String()
+		md.digest = result
+		_, computeErr = entry.SetMetadata(md)
+	})
+	if !loaded {
+		return "", &FileEntryNotFoundError{Name: name}
+	}
+	return result, computeErr
+}
+
+// listNames returns the relative names of every entry currently tracked by the
+// store's FileMap.
+func (op *localFileOp) listNames() ([]string, error) {
+	lister, ok := op.store.fileMap.(interface{ ListNames() []string })
+	if !ok {
+		return nil, fmt.Errorf("FileMap %T does not support listing names", op.store.fileMap)
+	}
+	return lister.ListNames(), nil
+}
+
+// checksumEntry hashes the current content of entry through the store's
+// injected afero.Fs (rather than talking to the "os" package directly, so
+// this works against NewMemFileStore's in-memory backend too), following a
+// symlink target first if followLinks is true, the entry is a symlink, and
+// the backing fs supports resolving links.
+func (op *localFileOp) checksumEntry(entry FileEntry, followLinks bool) (digest.Digest, error) {
+	p, err := entry.GetPath()
+	if err != nil {
+		return "", err
+	}
+	if followLinks {
+		if linker, ok := op.store.fs.(afero.LinkReader); ok {
+			if resolved, err := linker.ReadlinkIfPossible(p); err == nil {
+				p = resolved
+			}
+		}
+	}
+
+	f, err := op.store.fs.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), f); err != nil {
+		return "", err
+	}
+	return digester.Digest(), nil
+}